@@ -0,0 +1,39 @@
+// +build go1.9
+
+package shell
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTryLockWithBackoff(t *testing.T) {
+	t.Run("acquires immediately", func(t *testing.T) {
+		p := &Shell{config: &Config{LockTimeout: time.Second}}
+		acquired, _, err := p.tryLockWithBackoff(func() (bool, error) { return true, nil })
+		if err != nil || !acquired {
+			t.Fatalf("got acquired=%v err=%v, want acquired=true err=nil", acquired, err)
+		}
+	})
+
+	t.Run("propagates tryOnce error", func(t *testing.T) {
+		p := &Shell{config: &Config{LockTimeout: time.Second}}
+		wantErr := errors.New("boom")
+		_, _, err := p.tryLockWithBackoff(func() (bool, error) { return false, wantErr })
+		if err != wantErr {
+			t.Fatalf("got err=%v, want %v", err, wantErr)
+		}
+	})
+
+	t.Run("times out when never acquired", func(t *testing.T) {
+		p := &Shell{config: &Config{LockTimeout: 10 * time.Millisecond}}
+		acquired, elapsed, err := p.tryLockWithBackoff(func() (bool, error) { return false, nil })
+		if err != nil || acquired {
+			t.Fatalf("got acquired=%v err=%v, want acquired=false err=nil", acquired, err)
+		}
+		if elapsed < p.config.LockTimeout {
+			t.Fatalf("elapsed=%s, want at least the configured timeout %s", elapsed, p.config.LockTimeout)
+		}
+	})
+}
@@ -0,0 +1,306 @@
+// +build go1.9
+
+package shell
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4/database"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/lib/pq"
+)
+
+// Runner executes a single migration body against an established
+// connection. Implementations decide how to interpret the body: as SQL
+// run in a transaction, as a shell script dispatched to a subprocess, etc.
+type Runner interface {
+	Run(ctx context.Context, conn *sql.Conn, migration io.Reader) error
+}
+
+// markerSniffLen bounds how many leading bytes of a migration body Run and
+// RunNamed pass to RunnerRegistry when looking for a leading marker line.
+// Both still read the whole body into memory before dispatching it.
+const markerSniffLen = 256
+
+// RunnerRegistry dispatches a migration to a Runner, preferring the file
+// extension of its name and falling back to a marker line (e.g. a "#!"
+// shebang or a "-- +migrate sql" comment) when the name is unknown or has
+// no recognised extension.
+//
+// Extension-based dispatch only ever fires through Shell.RunNamed, which
+// migrate.Migrate never calls: Shell.Run, the only entry point
+// migrate.Migrate uses, always looks up an empty name, so in that pipeline
+// only the marker-line fallback is reachable.
+type RunnerRegistry struct {
+	byExtension map[string]Runner
+	byMarker    map[string]Runner
+
+	// Default is used when neither the extension nor a marker line
+	// identify a Runner. It preserves Shell's historical behavior of
+	// treating an unrecognised migration as a shell script.
+	Default Runner
+}
+
+// NewRunnerRegistry builds the default registry for shell: ".sql" files, and
+// bodies without a recognised extension whose first line starts with
+// "-- +migrate sql", run through SQLRunner; everything else (including ".sh"
+// files and anything unrecognised) runs through ShellRunner.
+func NewRunnerRegistry(shell *Shell) *RunnerRegistry {
+	sqlRunner := &SQLRunner{shell: shell}
+	shellRunner := &ShellRunner{shell: shell}
+
+	return &RunnerRegistry{
+		byExtension: map[string]Runner{
+			".sql": sqlRunner,
+			".sh":  shellRunner,
+		},
+		byMarker: map[string]Runner{
+			"-- +migrate sql": sqlRunner,
+			"#!":              shellRunner,
+		},
+		Default: shellRunner,
+	}
+}
+
+// Register adds or overrides the Runner used for the given file extension,
+// including the leading dot, e.g. ".py".
+func (r *RunnerRegistry) Register(extension string, runner Runner) {
+	r.byExtension[extension] = runner
+}
+
+// runnerFor picks a Runner for a migration named name with the given
+// leading bytes of its body.
+func (r *RunnerRegistry) runnerFor(name string, head []byte) Runner {
+	if runner, ok := r.byExtension[path.Ext(name)]; ok {
+		return runner
+	}
+
+	firstLine := string(head)
+	if idx := strings.IndexByte(firstLine, '\n'); idx >= 0 {
+		firstLine = firstLine[:idx]
+	}
+	for marker, runner := range r.byMarker {
+		if strings.HasPrefix(firstLine, marker) {
+			return runner
+		}
+	}
+
+	return r.Default
+}
+
+// SQLRunner executes a migration body as SQL against conn inside a
+// transaction, honoring the driver's StatementTimeout.
+type SQLRunner struct {
+	shell *Shell
+}
+
+func (r *SQLRunner) Run(ctx context.Context, conn *sql.Conn, migration io.Reader) error {
+	migr, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	query := string(migr)
+
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+
+	if timeout := r.shell.config.StatementTimeout; timeout > 0 {
+		timeoutQuery := fmt.Sprintf(`SET LOCAL statement_timeout = %d`, timeout/time.Millisecond)
+		if _, err := tx.ExecContext(ctx, timeoutQuery); err != nil {
+			if errRollback := tx.Rollback(); errRollback != nil {
+				err = multierror.Append(err, errRollback)
+			}
+			return &database.Error{OrigErr: err, Query: []byte(timeoutQuery)}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		if errRollback := tx.Rollback(); errRollback != nil {
+			err = multierror.Append(err, errRollback)
+		}
+		return &database.Error{OrigErr: err, Query: []byte(query), Err: sqlRunnerErrMessage(err, query)}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+
+	return nil
+}
+
+// sqlRunnerErrMessage enriches a *pq.Error with the line:col its reported
+// position falls on, matching the postgres driver's own error formatting.
+func sqlRunnerErrMessage(err error, query string) string {
+	pgErr, ok := err.(*pq.Error)
+	if !ok || pgErr.Position == "" {
+		return ""
+	}
+
+	pos, convErr := strconv.Atoi(pgErr.Position)
+	if convErr != nil {
+		return ""
+	}
+
+	line, col, ok := computeLineFromPos(query, pos)
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("%s (column %d, line %d)", pgErr.Message, col, line)
+}
+
+// ShellRunner executes a migration body as an executable subprocess, the
+// behavior historically built into Shell.Run.
+type ShellRunner struct {
+	shell *Shell
+}
+
+func (r *ShellRunner) Run(ctx context.Context, _ *sql.Conn, migration io.Reader) error {
+	p := r.shell
+
+	tempDir, err := ioutil.TempDir("", "migration_shell")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	migr, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+
+	executablePath := path.Join(tempDir, "migration")
+	if err := ioutil.WriteFile(executablePath, migr, 0700); err != nil {
+		return err
+	}
+
+	if p.config.ExecTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.ExecTimeout)
+		defer cancel()
+	}
+
+	var cmd *exec.Cmd
+	if len(p.config.Interpreter) > 0 {
+		args := append(append([]string{}, p.config.Interpreter[1:]...), executablePath)
+		cmd = exec.CommandContext(ctx, p.config.Interpreter[0], args...)
+	} else {
+		cmd = exec.CommandContext(ctx, executablePath)
+	}
+
+	cmd.Dir = tempDir
+	if p.config.WorkingDir != "" {
+		cmd.Dir = p.config.WorkingDir
+	}
+
+	version, _, _ := p.Version()
+	cmd.Env = p.buildEnv(version)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	logger := &syncWriter{w: p.logWriter()}
+	stderrTail := &tailBuffer{max: stderrTailSize}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		streamTagged("migration", stdout, logger)
+		done <- struct{}{}
+	}()
+	go func() {
+		streamTagged("migration", io.TeeReader(stderr, stderrTail), logger)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return &database.Error{
+				OrigErr: exitErr,
+				Err: fmt.Sprintf("shell migration exited with code %d, stderr: %s",
+					exitStatus(exitErr), stderrTail.String()),
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// streamTagged copies r to w line by line, prefixing each line with tag so
+// interleaved migration output can be told apart from the migrator's own
+// logging.
+func streamTagged(tag string, r io.Reader, w io.Writer) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fmt.Fprintf(w, "[%s] %s\n", tag, scanner.Text())
+	}
+}
+
+// syncWriter serializes writes to w, so the stdout and stderr streaming
+// goroutines in ShellRunner.Run can share a single Logger without racing on
+// writers that aren't concurrency-safe.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// tailBuffer keeps only the last max bytes written to it, so that capturing
+// a failing migration's stderr doesn't require holding all of it in memory.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
+
+// exitStatus extracts the process exit code from err, or -1 if it can't be
+// determined.
+func exitStatus(err *exec.ExitError) int {
+	if ws, ok := err.Sys().(syscall.WaitStatus); ok {
+		return ws.ExitStatus()
+	}
+	return -1
+}
@@ -0,0 +1,42 @@
+// +build go1.9
+
+package shell
+
+import "testing"
+
+func TestRunnerRegistryRunnerFor(t *testing.T) {
+	sqlRunner := &SQLRunner{}
+	shellRunner := &ShellRunner{}
+	registry := &RunnerRegistry{
+		byExtension: map[string]Runner{
+			".sql": sqlRunner,
+			".sh":  shellRunner,
+		},
+		byMarker: map[string]Runner{
+			"-- +migrate sql": sqlRunner,
+			"#!":              shellRunner,
+		},
+		Default: shellRunner,
+	}
+
+	tests := []struct {
+		desc string
+		name string
+		head []byte
+		want Runner
+	}{
+		{"extension wins over marker", "1_init.sql", []byte("#!/bin/sh\necho hi\n"), sqlRunner},
+		{"marker used when extension is unknown", "1_init", []byte("-- +migrate sql\nSELECT 1;\n"), sqlRunner},
+		{"shebang marker", "1_init", []byte("#!/bin/sh\necho hi\n"), shellRunner},
+		{"falls back to default", "1_init", []byte("echo hi\n"), shellRunner},
+		{"empty name and body falls back to default", "", nil, shellRunner},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got := registry.runnerFor(tt.name, tt.head); got != tt.want {
+				t.Errorf("runnerFor(%q, %q) = %T, want %T", tt.name, tt.head, got, tt.want)
+			}
+		})
+	}
+}
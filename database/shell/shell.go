@@ -3,15 +3,18 @@
 package shell
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	nurl "net/url"
 	"os"
-	"os/exec"
-	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -40,16 +43,126 @@ type Config struct {
 	DatabaseName     string
 	SchemaName       string
 	StatementTimeout time.Duration
+
+	// DatabaseURL is the DSN used to connect to the database. It is exposed
+	// to shell migrations as the DATABASE_URL environment variable.
+	DatabaseURL string
+
+	// ExecTimeout bounds how long a single shell migration is allowed to
+	// run before it is killed. Zero means no timeout.
+	ExecTimeout time.Duration
+
+	// EnvAllowlist names environment variables that are copied from the
+	// migrator's own environment into the migration subprocess. DATABASE_URL,
+	// MIGRATION_VERSION and SCHEMA_NAME are always injected regardless of
+	// this list.
+	EnvAllowlist []string
+
+	// WorkingDir is the directory the migration subprocess runs in. Defaults
+	// to the temporary directory the migration body is written to.
+	WorkingDir string
+
+	// Interpreter dispatches shell migrations that have no shebang line or
+	// executable bit, e.g. []string{"bash"} or []string{"python3"}. The
+	// migration's temp file path is appended as the interpreter's final
+	// argument. Leave empty to execute the migration file directly.
+	Interpreter []string
+
+	// Logger receives the tagged stdout/stderr of shell migrations as they
+	// run. Defaults to os.Stderr.
+	Logger io.Writer
+
+	// ChecksumMode controls what happens when RunNamed finds that a
+	// migration's recorded checksum doesn't match the body about to run.
+	// Repeatable migrations are never compared, since they re-run when their
+	// body changes. Defaults to ChecksumIgnore. Since migrate.Migrate only ever calls Run,
+	// never RunNamed, this has no effect unless the caller invokes RunNamed
+	// directly.
+	ChecksumMode ChecksumMode
+
+	// LockTimeout bounds how long Lock waits to acquire the advisory lock.
+	// Zero (the default) waits indefinitely, matching Shell's historical
+	// behavior.
+	LockTimeout time.Duration
+
+	// LockMode selects whether the advisory lock is scoped to the Shell's
+	// session (released by Unlock, or by the session ending) or to a
+	// transaction held open between Lock and Unlock. Defaults to
+	// LockModeSession.
+	LockMode LockMode
+}
+
+// LockMode selects the flavor of PostgreSQL advisory lock Shell takes out.
+type LockMode int
+
+const (
+	// LockModeSession uses pg_advisory_lock, released by an explicit
+	// pg_advisory_unlock or when the session ends.
+	LockModeSession LockMode = iota
+	// LockModeTransaction uses pg_advisory_xact_lock, held open inside a
+	// transaction and released automatically when that transaction ends.
+	LockModeTransaction
+)
+
+// ChecksumMode controls how RunNamed reacts when a migration's previously
+// recorded checksum doesn't match the body about to be executed, i.e. the
+// migration file was edited after it was applied.
+type ChecksumMode int
+
+const (
+	// ChecksumIgnore never compares checksums.
+	ChecksumIgnore ChecksumMode = iota
+	// ChecksumWarn logs a mismatch to Config.Logger (or os.Stderr) but lets
+	// the migration run anyway.
+	ChecksumWarn
+	// ChecksumStrict rejects execution when a mismatch is found.
+	ChecksumStrict
+)
+
+// MigrationKind distinguishes ordinary versioned migrations, applied once
+// and tracked by version number, from repeatable migrations that re-run
+// whenever their body changes and are tracked by a hash of their name.
+type MigrationKind string
+
+const (
+	KindVersioned  MigrationKind = "versioned"
+	KindRepeatable MigrationKind = "repeatable"
+)
+
+// AppliedMigration is a row of the migrations table.
+type AppliedMigration struct {
+	Version     int64
+	Checksum    string
+	AppliedAt   time.Time
+	ExecutionMs int
+	Dirty       bool
+	Kind        MigrationKind
 }
 
 type Shell struct {
-	// Locking and unlocking need to use the same connection
+	// conn is used for everything except the advisory lock transaction in
+	// LockModeTransaction (see lockConn): migrations and session-mode
+	// locking/unlocking all need to run on the same connection.
 	conn     *sql.Conn
 	db       *sql.DB
 	isLocked bool
 
+	// lockConn and lockTx hold the dedicated connection and transaction the
+	// advisory lock was taken in, when Config.LockMode is
+	// LockModeTransaction. They must not be p.conn: SetVersion and
+	// SQLRunner.Run each open and commit their own transaction on p.conn for
+	// every migration, and since Postgres has no true nested transactions,
+	// that inner COMMIT would commit (and thus release) the lock
+	// transaction if it shared p.conn.
+	lockConn *sql.Conn
+	lockTx   *sql.Tx
+
 	// Open and WithInstance need to guarantee that config is never nil
 	config *Config
+
+	// Runners dispatches a migration to a SQLRunner, a ShellRunner, or a
+	// caller-registered Runner, based on its name or a leading marker line.
+	Runners *RunnerRegistry
 }
 
 func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
@@ -104,6 +217,7 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		db:     instance,
 		config: config,
 	}
+	px.Runners = NewRunnerRegistry(px)
 
 	if err := px.ensureVersionTable(); err != nil {
 		return nil, err
@@ -135,10 +249,50 @@ func (p *Shell) Open(url string) (database.Driver, error) {
 		}
 	}
 
+	execTimeoutString := purl.Query().Get("x-exec-timeout")
+	execTimeout := 0
+	if execTimeoutString != "" {
+		execTimeout, err = strconv.Atoi(execTimeoutString)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var envAllowlist []string
+	if allowlist := purl.Query().Get("x-env-allowlist"); allowlist != "" {
+		envAllowlist = strings.Split(allowlist, ",")
+	}
+
+	var interpreter []string
+	if shebang := purl.Query().Get("x-interpreter"); shebang != "" {
+		interpreter = strings.Fields(shebang)
+	}
+
+	lockTimeoutString := purl.Query().Get("x-lock-timeout")
+	lockTimeout := 0
+	if lockTimeoutString != "" {
+		lockTimeout, err = strconv.Atoi(lockTimeoutString)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lockMode := LockModeSession
+	if purl.Query().Get("x-lock-mode") == "transaction" {
+		lockMode = LockModeTransaction
+	}
+
 	px, err := WithInstance(db, &Config{
 		DatabaseName:     purl.Path,
 		MigrationsTable:  migrationsTable,
 		StatementTimeout: time.Duration(statementTimeout) * time.Millisecond,
+		DatabaseURL:      postgresDsn,
+		ExecTimeout:      time.Duration(execTimeout) * time.Millisecond,
+		EnvAllowlist:     envAllowlist,
+		WorkingDir:       purl.Query().Get("x-working-dir"),
+		Interpreter:      interpreter,
+		LockTimeout:      time.Duration(lockTimeout) * time.Millisecond,
+		LockMode:         lockMode,
 	})
 
 	if err != nil {
@@ -158,6 +312,11 @@ func (p *Shell) Close() error {
 }
 
 // https://www.postgresql.org/docs/9.6/static/explicit-locking.html#ADVISORY-LOCKS
+//
+// If Config.LockTimeout is zero, this waits indefinitely until the lock can
+// be acquired, as it always has. Otherwise it polls pg_try_advisory_lock
+// (or pg_try_advisory_xact_lock in LockModeTransaction) with exponential
+// backoff until the lock is acquired or the timeout elapses.
 func (p *Shell) Lock() error {
 	if p.isLocked {
 		return database.ErrLocked
@@ -168,21 +327,165 @@ func (p *Shell) Lock() error {
 		return err
 	}
 
-	// This will wait indefinitely until the lock can be acquired.
-	query := `SELECT pg_advisory_lock($1)`
-	if _, err := p.conn.ExecContext(context.Background(), query, aid); err != nil {
-		return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+	if p.config.LockMode == LockModeTransaction {
+		return p.lockTransaction(aid)
+	}
+	return p.lockSession(aid)
+}
+
+func (p *Shell) lockSession(aid string) error {
+	if p.config.LockTimeout <= 0 {
+		query := `SELECT pg_advisory_lock($1)`
+		if _, err := p.conn.ExecContext(context.Background(), query, aid); err != nil {
+			return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+		}
+		p.isLocked = true
+		return nil
+	}
+
+	query := `SELECT pg_try_advisory_lock($1)`
+	acquired, elapsed, err := p.tryLockWithBackoff(func() (bool, error) {
+		var ok bool
+		if err := p.conn.QueryRowContext(context.Background(), query, aid).Scan(&ok); err != nil {
+			return false, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		return ok, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("%w: timed out after %s", database.ErrLocked, elapsed)
+	}
+
+	p.isLocked = true
+	return nil
+}
+
+// lockTransaction takes the advisory lock on a dedicated connection rather
+// than p.conn, so that SetVersion and SQLRunner.Run committing their own
+// per-migration transactions on p.conn can't prematurely commit (and so
+// release) this one.
+func (p *Shell) lockTransaction(aid string) error {
+	conn, err := p.db.Conn(context.Background())
+	if err != nil {
+		return err
 	}
 
+	tx, err := conn.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		conn.Close()
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+
+	if p.config.LockTimeout <= 0 {
+		query := `SELECT pg_advisory_xact_lock($1)`
+		if _, err := tx.ExecContext(context.Background(), query, aid); err != nil {
+			if errRollback := tx.Rollback(); errRollback != nil {
+				err = multierror.Append(err, errRollback)
+			}
+			conn.Close()
+			return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+		}
+		p.lockConn = conn
+		p.lockTx = tx
+		p.isLocked = true
+		return nil
+	}
+
+	query := `SELECT pg_try_advisory_xact_lock($1)`
+	acquired, elapsed, err := p.tryLockWithBackoff(func() (bool, error) {
+		var ok bool
+		if err := tx.QueryRowContext(context.Background(), query, aid).Scan(&ok); err != nil {
+			return false, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		return ok, nil
+	})
+	if err != nil {
+		if errRollback := tx.Rollback(); errRollback != nil {
+			err = multierror.Append(err, errRollback)
+		}
+		conn.Close()
+		return err
+	}
+	if !acquired {
+		timeoutErr := fmt.Errorf("%w: timed out after %s", database.ErrLocked, elapsed)
+		if errRollback := tx.Rollback(); errRollback != nil {
+			timeoutErr = multierror.Append(timeoutErr, errRollback)
+		}
+		conn.Close()
+		return timeoutErr
+	}
+
+	p.lockConn = conn
+	p.lockTx = tx
 	p.isLocked = true
 	return nil
 }
 
+// tryLockWithBackoff calls tryOnce until it reports success or
+// Config.LockTimeout elapses, sleeping a jittered, exponentially growing
+// interval (starting at 50ms, capped at 2s) between attempts.
+func (p *Shell) tryLockWithBackoff(tryOnce func() (bool, error)) (acquired bool, elapsed time.Duration, err error) {
+	const (
+		initialBackoff = 50 * time.Millisecond
+		maxBackoff     = 2 * time.Second
+	)
+
+	start := time.Now()
+	deadline := start.Add(p.config.LockTimeout)
+	backoff := initialBackoff
+
+	for {
+		ok, err := tryOnce()
+		if err != nil {
+			return false, time.Since(start), err
+		}
+		if ok {
+			return true, time.Since(start), nil
+		}
+
+		now := time.Now()
+		if !now.Before(deadline) {
+			return false, now.Sub(start), nil
+		}
+
+		sleep := backoff
+		if remaining := deadline.Sub(now); remaining < sleep {
+			sleep = remaining
+		}
+		time.Sleep(time.Duration(float64(sleep) * (0.5 + rand.Float64()*0.5)))
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
 func (p *Shell) Unlock() error {
 	if !p.isLocked {
 		return nil
 	}
 
+	if p.config.LockMode == LockModeTransaction {
+		err := p.lockTx.Commit()
+		closeErr := p.lockConn.Close()
+		p.lockTx = nil
+		p.lockConn = nil
+		p.isLocked = false
+		if err != nil {
+			if closeErr != nil {
+				err = multierror.Append(err, closeErr)
+			}
+			return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+		return nil
+	}
+
 	aid, err := database.GenerateAdvisoryLockId(p.config.DatabaseName, p.config.SchemaName)
 	if err != nil {
 		return err
@@ -196,32 +499,292 @@ func (p *Shell) Unlock() error {
 	return nil
 }
 
-func (p *Shell) Run(migration io.Reader) error {
-	tempDir, err := ioutil.TempDir("", "migration_shell")
+// ForceUnlock clears a stuck migration lock left behind by a crashed or
+// killed migrator. pg_advisory_unlock_all() only releases locks held by the
+// calling session, which is never the stuck one, so instead this looks up
+// the backend(s) actually holding the advisory lock via pg_locks and
+// terminates them.
+//
+// This is considerably more destructive than "unlock" suggests: it kills
+// the backend process of whoever currently holds the lock, not just the
+// lock itself. If that backend is a legitimately-running migration rather
+// than a stuck one, ForceUnlock kills it just the same. Only call this once
+// you've confirmed the lock holder is actually dead, not merely slow.
+func (p *Shell) ForceUnlock() error {
+	aid, err := database.GenerateAdvisoryLockId(p.config.DatabaseName, p.config.SchemaName)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(tempDir)
 
-	migr, err := ioutil.ReadAll(migration)
+	query := `SELECT pid FROM pg_locks
+		WHERE locktype = 'advisory'
+		  AND pid <> pg_backend_pid()
+		  AND (classid::bit(32) || objid::bit(32))::bit(64)::bigint = $1`
+	rows, err := p.conn.QueryContext(context.Background(), query, aid)
 	if err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	var pids []int
+	for rows.Next() {
+		var pid int
+		if err := rows.Scan(&pid); err != nil {
+			return err
+		}
+		pids = append(pids, pid)
+	}
+	if err := rows.Err(); err != nil {
 		return err
 	}
 
-	executablePath := path.Join(tempDir, "migration")
-	err = ioutil.WriteFile(executablePath, migr, 0700)
+	terminate := `SELECT pg_terminate_backend($1)`
+	for _, pid := range pids {
+		if _, err := p.conn.ExecContext(context.Background(), terminate, pid); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(terminate)}
+		}
+	}
+
+	return nil
+}
+
+// stderrTailSize bounds how much of a failing shell migration's stderr is
+// kept around to enrich the returned database.Error.
+const stderrTailSize = 4 * 1024
+
+// Run implements database.Driver. This is the only entry point
+// migrate.Migrate ever calls, and it is never given a filename, so
+// RunnerRegistry's extension-based dispatch can't fire here: Run sniffs the
+// body's leading marker line instead (e.g. "-- +migrate sql" or a "#!"
+// shebang), falling back to Runners.Default when neither is present. It
+// also never sees checksums, execution timing or migration kind, since
+// those are only recorded by RunNamed. Callers who manage their own source
+// reading and want extension-based dispatch or history tracking should call
+// RunNamed directly instead of going through migrate.Migrate.
+func (p *Shell) Run(migration io.Reader) error {
+	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
 	}
 
-	err = exec.Command(executablePath).Run()
+	head := migr
+	if len(head) > markerSniffLen {
+		head = head[:markerSniffLen]
+	}
+
+	runner := p.Runners.runnerFor("", head)
+	return runner.Run(context.Background(), p.conn, bytes.NewReader(migr))
+}
+
+// RunNamed executes a migration whose name (including extension) is known,
+// dispatching it to the Runner registered in Runners for that name. Unlike
+// Run, it also tracks the migration's checksum, kind and execution time in
+// the migrations table, and can reject execution when the recorded
+// checksum for its version no longer matches (see Config.ChecksumMode).
+//
+// database.Driver has no optional interface migrate.Migrate upgrades to for
+// this, so RunNamed is never called by migrate.Migrate's Up/Down/Steps —
+// only Run is. RunNamed, and the extension-based dispatch and checksum/kind
+// tracking it enables, are only exercised by callers that read migration
+// sources themselves and invoke it directly.
+func (p *Shell) RunNamed(name string, migration io.Reader) error {
+	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
 	}
 
+	head := migr
+	if len(head) > markerSniffLen {
+		head = head[:markerSniffLen]
+	}
+
+	kind := KindVersioned
+	version, ok := parseVersion(name)
+	if !ok {
+		kind = KindRepeatable
+		version = repeatableVersion(name)
+	}
+
+	ctx := context.Background()
+	checksum := checksumOf(migr)
+	if p.config.ChecksumMode != ChecksumIgnore && kind == KindVersioned {
+		if err := p.checkChecksum(ctx, version, checksum); err != nil {
+			return err
+		}
+	}
+
+	runner := p.Runners.runnerFor(name, head)
+	start := time.Now()
+	runErr := runner.Run(ctx, p.conn, bytes.NewReader(migr))
+	executionMs := int(time.Since(start) / time.Millisecond)
+
+	if recordErr := p.recordExecution(ctx, version, kind, checksum, runErr != nil, executionMs); recordErr != nil {
+		if runErr != nil {
+			return multierror.Append(runErr, recordErr)
+		}
+		return recordErr
+	}
+
+	return runErr
+}
+
+// parseVersion extracts the leading integer version prefix from a
+// migration filename such as "000001_create_users.up.sql", the convention
+// golang-migrate's source drivers use to name migration files.
+func parseVersion(name string) (int64, bool) {
+	base := name
+	if idx := strings.LastIndexByte(base, '/'); idx >= 0 {
+		base = base[idx+1:]
+	}
+
+	i := 0
+	for i < len(base) && base[i] >= '0' && base[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return 0, false
+	}
+
+	version, err := strconv.ParseInt(base[:i], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+// repeatableVersion derives a stable pseudo-version for a repeatable
+// migration's row in the migrations table, so it can share the version
+// bigint primary key with ordinary migrations. It always returns a value
+// of -2 or lower, since real versions (and the dirty sentinel written by
+// SetVersion) are never below -1.
+func repeatableVersion(name string) int64 {
+	h := fnv.New64a()
+	_, _ = io.WriteString(h, name)
+	return -2 - int64(h.Sum64()>>2)
+}
+
+// checksumOf returns the hex-encoded SHA-256 of a migration body.
+func checksumOf(migr []byte) string {
+	sum := sha256.Sum256(migr)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkChecksum compares checksum against the one recorded for version, if
+// any, and reacts according to Config.ChecksumMode. Only called from
+// RunNamed, which migrate.Migrate never invokes (see Shell.Run), so this
+// only runs for callers that invoke RunNamed directly.
+func (p *Shell) checkChecksum(ctx context.Context, version int64, checksum string) error {
+	query := `SELECT checksum FROM ` + pq.QuoteIdentifier(p.config.MigrationsTable) + ` WHERE version = $1`
+
+	var recorded string
+	err := p.conn.QueryRowContext(ctx, query, version).Scan(&recorded)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	case recorded == "" || recorded == checksum:
+		return nil
+	}
+
+	mismatch := fmt.Errorf("checksum mismatch for migration version %d: recorded %s, got %s", version, recorded, checksum)
+	return checksumMismatchAction(p.config.ChecksumMode, mismatch, p.logWriter())
+}
+
+// checksumMismatchAction decides how checkChecksum reacts to a checksum
+// mismatch for mode, writing a warning to logger when appropriate.
+func checksumMismatchAction(mode ChecksumMode, mismatch error, logger io.Writer) error {
+	switch mode {
+	case ChecksumStrict:
+		return &database.Error{OrigErr: mismatch, Err: mismatch.Error()}
+	case ChecksumWarn:
+		fmt.Fprintf(logger, "[migration] warning: %s\n", mismatch)
+	}
 	return nil
 }
 
+// recordExecution upserts the migrations table row for version with the
+// outcome of running a migration, preserving the history of prior runs of
+// other versions (unlike the historical TRUNCATE-on-every-call behavior of
+// SetVersion). Only called from RunNamed: migrations run through Run (and
+// so through migrate.Migrate's Up/Down/Steps) never populate checksum,
+// execution_ms or kind — those columns stay at their defaults, and only
+// SetVersion's plain version/dirty row is written.
+func (p *Shell) recordExecution(ctx context.Context, version int64, kind MigrationKind, checksum string, dirty bool, executionMs int) error {
+	query := `INSERT INTO ` + pq.QuoteIdentifier(p.config.MigrationsTable) +
+		` (version, checksum, applied_at, execution_ms, dirty, kind) VALUES ($1, $2, now(), $3, $4, $5)
+		  ON CONFLICT (version) DO UPDATE SET
+		    checksum = EXCLUDED.checksum,
+		    applied_at = EXCLUDED.applied_at,
+		    execution_ms = EXCLUDED.execution_ms,
+		    dirty = EXCLUDED.dirty,
+		    kind = EXCLUDED.kind`
+	if _, err := p.conn.ExecContext(ctx, query, version, checksum, executionMs, dirty, string(kind)); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+// AppliedMigrations returns every row of the migrations table, including
+// repeatable migrations, ordered by version. When migrations were applied
+// through migrate.Migrate (which drives Shell via Run, not RunNamed), every
+// row will show an empty checksum, zero execution_ms and kind "versioned":
+// those fields are only populated for migrations applied via RunNamed.
+func (p *Shell) AppliedMigrations() ([]AppliedMigration, error) {
+	query := `SELECT version, checksum, applied_at, execution_ms, dirty, kind FROM ` +
+		pq.QuoteIdentifier(p.config.MigrationsTable) + ` ORDER BY version`
+
+	rows, err := p.conn.QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	var applied []AppliedMigration
+	for rows.Next() {
+		var m AppliedMigration
+		var kind string
+		if err := rows.Scan(&m.Version, &m.Checksum, &m.AppliedAt, &m.ExecutionMs, &m.Dirty, &kind); err != nil {
+			return nil, err
+		}
+		m.Kind = MigrationKind(kind)
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// buildEnv assembles the environment a shell migration subprocess runs
+// with: the allow-listed variables from the migrator's own environment,
+// plus DATABASE_URL, MIGRATION_VERSION and SCHEMA_NAME derived from the
+// driver's config.
+func (p *Shell) buildEnv(migrationVersion int) []string {
+	allowed := make(map[string]struct{}, len(p.config.EnvAllowlist))
+	for _, name := range p.config.EnvAllowlist {
+		allowed[name] = struct{}{}
+	}
+
+	env := make([]string, 0, len(allowed)+3)
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if _, ok := allowed[name]; ok {
+			env = append(env, kv)
+		}
+	}
+
+	return append(env,
+		"DATABASE_URL="+p.config.DatabaseURL,
+		"MIGRATION_VERSION="+strconv.Itoa(migrationVersion),
+		"SCHEMA_NAME="+p.config.SchemaName,
+	)
+}
+
+func (p *Shell) logWriter() io.Writer {
+	if p.config.Logger != nil {
+		return p.config.Logger
+	}
+	return os.Stderr
+}
+
 func computeLineFromPos(s string, pos int) (line uint, col uint, ok bool) {
 	// replace crlf with lf
 	s = strings.Replace(s, "\r\n", "\n", -1)
@@ -257,34 +820,34 @@ func runesLastIndex(input []rune, target rune) int {
 	return -1
 }
 
+// SetVersion records the current version and its dirty flag. Unlike the
+// single-row table this driver used to maintain, rows for earlier versions
+// are kept rather than discarded, so AppliedMigrations can return history
+// and RunNamed can detect checksum drift.
+//
+// Also re-write the schema version for nil dirty versions to prevent
+// empty schema version for failed down migration on the first migration
+// See: https://github.com/golang-migrate/migrate/issues/330
 func (p *Shell) SetVersion(version int, dirty bool) error {
+	// Always upsert, including a clean rollback to database.NilVersion: the
+	// row at that version becomes the most recently applied_at versioned
+	// row, so Version() reports NilVersion again instead of continuing to
+	// return whatever version was previously latest.
 	tx, err := p.conn.BeginTx(context.Background(), &sql.TxOptions{})
 	if err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction start failed"}
 	}
 
-	query := `TRUNCATE ` + pq.QuoteIdentifier(p.config.MigrationsTable)
-	if _, err := tx.Exec(query); err != nil {
+	query := `INSERT INTO ` + pq.QuoteIdentifier(p.config.MigrationsTable) +
+		` (version, dirty, kind) VALUES ($1, $2, $3)
+		  ON CONFLICT (version) DO UPDATE SET dirty = EXCLUDED.dirty, applied_at = now()`
+	if _, err := tx.Exec(query, version, dirty, string(KindVersioned)); err != nil {
 		if errRollback := tx.Rollback(); errRollback != nil {
 			err = multierror.Append(err, errRollback)
 		}
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
-	// Also re-write the schema version for nil dirty versions to prevent
-	// empty schema version for failed down migration on the first migration
-	// See: https://github.com/golang-migrate/migrate/issues/330
-	if version >= 0 || (version == database.NilVersion && dirty) {
-		query = `INSERT INTO ` + pq.QuoteIdentifier(p.config.MigrationsTable) +
-			` (version, dirty) VALUES ($1, $2)`
-		if _, err := tx.Exec(query, version, dirty); err != nil {
-			if errRollback := tx.Rollback(); errRollback != nil {
-				err = multierror.Append(err, errRollback)
-			}
-			return &database.Error{OrigErr: err, Query: []byte(query)}
-		}
-	}
-
 	if err := tx.Commit(); err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
 	}
@@ -292,9 +855,15 @@ func (p *Shell) SetVersion(version int, dirty bool) error {
 	return nil
 }
 
+// Version returns the most recently applied non-repeatable migration,
+// preserving the single "current version" contract callers relied on
+// before the migrations table tracked history.
 func (p *Shell) Version() (version int, dirty bool, err error) {
-	query := `SELECT version, dirty FROM ` + pq.QuoteIdentifier(p.config.MigrationsTable) + ` LIMIT 1`
-	err = p.conn.QueryRowContext(context.Background(), query).Scan(&version, &dirty)
+	query := `SELECT version, dirty FROM ` + pq.QuoteIdentifier(p.config.MigrationsTable) +
+		` WHERE kind = '` + string(KindVersioned) + `' ORDER BY applied_at DESC, version DESC LIMIT 1`
+
+	var v int64
+	err = p.conn.QueryRowContext(context.Background(), query).Scan(&v, &dirty)
 	switch {
 	case err == sql.ErrNoRows:
 		return database.NilVersion, false, nil
@@ -308,7 +877,7 @@ func (p *Shell) Version() (version int, dirty bool, err error) {
 		return 0, false, &database.Error{OrigErr: err, Query: []byte(query)}
 
 	default:
-		return version, dirty, nil
+		return int(v), dirty, nil
 	}
 }
 
@@ -368,10 +937,58 @@ func (p *Shell) ensureVersionTable() (err error) {
 		}
 	}()
 
-	query := `CREATE TABLE IF NOT EXISTS ` + pq.QuoteIdentifier(p.config.MigrationsTable) + ` (version bigint not null primary key, dirty boolean not null)`
+	query := `CREATE TABLE IF NOT EXISTS ` + pq.QuoteIdentifier(p.config.MigrationsTable) + ` (
+		version bigint not null primary key,
+		checksum text not null default '',
+		applied_at timestamptz not null default now(),
+		execution_ms int not null default 0,
+		dirty boolean not null,
+		kind text not null default '` + string(KindVersioned) + `'
+	)`
 	if _, err = p.conn.ExecContext(context.Background(), query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
+	return p.upgradeLegacyVersionTable()
+}
+
+// upgradeLegacyVersionTable detects a migrations table created by a
+// version of this driver that only tracked (version, dirty), and adds the
+// checksum/applied_at/execution_ms/kind columns in place so existing
+// deployments don't need a manual migration of the migrations table
+// itself. Must be called while the advisory lock is held.
+func (p *Shell) upgradeLegacyVersionTable() error {
+	query := `SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1`
+	rows, err := p.conn.QueryContext(context.Background(), query, p.config.MigrationsTable)
+	if err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	columns := make(map[string]struct{})
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		columns[name] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, ok := columns["checksum"]; ok {
+		return nil
+	}
+
+	alter := `ALTER TABLE ` + pq.QuoteIdentifier(p.config.MigrationsTable) + `
+		ADD COLUMN checksum text not null default '',
+		ADD COLUMN applied_at timestamptz not null default now(),
+		ADD COLUMN execution_ms int not null default 0,
+		ADD COLUMN kind text not null default '` + string(KindVersioned) + `'`
+	if _, err := p.conn.ExecContext(context.Background(), alter); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(alter)}
+	}
+
 	return nil
 }
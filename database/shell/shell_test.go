@@ -0,0 +1,66 @@
+// +build go1.9
+
+package shell
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int64
+		ok      bool
+	}{
+		{"1_init.sql", 1, true},
+		{"0001_init.sql", 1, true},
+		{"20201231_create_users.sql", 20201231, true},
+		{"migrations/20201231_create_users.sql", 20201231, true},
+		{"init.sql", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		version, ok := parseVersion(tt.name)
+		if ok != tt.ok || version != tt.version {
+			t.Errorf("parseVersion(%q) = (%d, %v), want (%d, %v)", tt.name, version, ok, tt.version, tt.ok)
+		}
+	}
+}
+
+func TestRepeatableVersion(t *testing.T) {
+	v1 := repeatableVersion("views/active_users.sql")
+	v2 := repeatableVersion("views/active_users.sql")
+	if v1 != v2 {
+		t.Fatalf("repeatableVersion is not stable: %d != %d", v1, v2)
+	}
+	if v1 > -2 {
+		t.Fatalf("repeatableVersion(%d) must be <= -2 to avoid colliding with real versions or the dirty sentinel", v1)
+	}
+
+	if other := repeatableVersion("views/other_view.sql"); other == v1 {
+		t.Fatalf("repeatableVersion collided for distinct names: %d", v1)
+	}
+}
+
+func TestChecksumMismatchAction(t *testing.T) {
+	mismatch := errors.New("checksum mismatch for migration version 1: recorded a, got b")
+
+	if err := checksumMismatchAction(ChecksumIgnore, mismatch, &bytes.Buffer{}); err != nil {
+		t.Errorf("ChecksumIgnore: expected nil error, got %v", err)
+	}
+
+	var warnLog bytes.Buffer
+	if err := checksumMismatchAction(ChecksumWarn, mismatch, &warnLog); err != nil {
+		t.Errorf("ChecksumWarn: expected nil error, got %v", err)
+	}
+	if warnLog.Len() == 0 {
+		t.Error("ChecksumWarn: expected a warning to be logged")
+	}
+
+	if err := checksumMismatchAction(ChecksumStrict, mismatch, &bytes.Buffer{}); err == nil {
+		t.Error("ChecksumStrict: expected a non-nil error")
+	}
+}